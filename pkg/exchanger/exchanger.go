@@ -21,9 +21,12 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -33,12 +36,15 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/proxy"
+	"k8s.io/apimachinery/pkg/util/sets"
 	genericfeatures "k8s.io/apiserver/pkg/features"
 	"k8s.io/apiserver/pkg/registry/rest"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/transport"
 	"k8s.io/klog/v2"
 
+	clusterapi "github.com/clusternet/clusternet/pkg/apis/clusters/v1beta1"
 	proxies "github.com/clusternet/clusternet/pkg/apis/proxies/v1alpha1"
 	clusterInformers "github.com/clusternet/clusternet/pkg/generated/informers/externalversions/clusters/v1beta1"
 	clusterListers "github.com/clusternet/clusternet/pkg/generated/listers/clusters/v1beta1"
@@ -46,8 +52,15 @@ import (
 )
 
 type Exchanger struct {
-	// use cachedTransports to speed up networking connections
-	cachedTransports map[string]*http.Transport
+	// dialHolders keeps one *transport.DialHolder per clusterID (bounded the same way the old
+	// cachedTransports map was) so that repeated calls for a cluster reuse the very same dialer
+	// pointer, which lets client-go's internal tlsTransportCache (see k8s.io/client-go/transport)
+	// dedupe the underlying *http.Transport and its TLS session cache per distinct TLS config
+	// instead of us rebuilding one per request. Keying on TLS material too would grow this map
+	// without bound as distinct client certs came and went, so the dial holder is shared across
+	// certs for a cluster; client-go's own cache still keys the resulting transport by the full
+	// TLS config, so different certs/CAs for the same cluster still get distinct transports.
+	dialHolders map[string]*transport.DialHolder
 
 	lock sync.Mutex
 
@@ -56,6 +69,18 @@ type Exchanger struct {
 
 	mcLister clusterListers.ManagedClusterLister
 	mcSynced cache.InformerSynced
+
+	// disableHTTP2 forces tunneled transports down to HTTP/1.1, for debugging. HTTP/2 is
+	// multiplexed by default so a single dialed connection through the tunnel can carry many
+	// concurrent apiserver requests as HTTP/2 streams, instead of head-of-line-blocking on one
+	// HTTP/1.1 connection per in-flight request.
+	disableHTTP2 bool
+
+	// impersonationAllowlist gates which managed clusters will have their caller's
+	// Clusternet-Impersonate-* headers honored. Clusters whose ID isn't in the set have those
+	// headers stripped and ignored like any other extra, so untrusted callers can't escalate by
+	// impersonating an arbitrary identity on a cluster the operator hasn't explicitly opted in.
+	impersonationAllowlist sets.String
 }
 
 var (
@@ -66,6 +91,21 @@ const (
 	TokenHeaderKey       = "Clusternet-Token"
 	CertificateHeaderKey = "Clusternet-Certificate"
 	PrivateKeyHeaderKey  = "Clusternet-PrivateKey"
+	CABundleHeaderKey    = "Clusternet-CABundle"
+
+	// Impersonate* header keys let a caller holding a single service account token also
+	// impersonate a downstream RBAC identity on the managed cluster. They are only honored
+	// for clusters whose ID is in the impersonationAllowlist passed to NewExchanger.
+	ImpersonateUserHeaderKey     = "Clusternet-Impersonate-User"
+	ImpersonateGroupHeaderKey    = "Clusternet-Impersonate-Group"
+	ImpersonateUIDHeaderKey      = "Clusternet-Impersonate-Uid"
+	ImpersonateExtraHeaderPrefix = "Clusternet-Impersonate-Extra-"
+
+	// standard Kubernetes impersonation headers Impersonate* translate into on the outbound request
+	impersonateUserHeader        = "Impersonate-User"
+	impersonateGroupHeader       = "Impersonate-Group"
+	impersonateUIDHeader         = "Impersonate-Uid"
+	impersonateExtraHeaderPrefix = "Impersonate-Extra-"
 )
 
 func authorizer(req *http.Request) (string, bool, error) {
@@ -73,46 +113,119 @@ func authorizer(req *http.Request) (string, bool, error) {
 	return clusterID, clusterID != "", nil
 }
 
-func NewExchanger(tunnelLogging bool, mclsInformer clusterInformers.ManagedClusterInformer) *Exchanger {
+// NewExchanger builds an Exchanger. impersonationAllowlist holds the IDs of managed clusters
+// permitted to honor an incoming caller's Clusternet-Impersonate-* headers; clusters not in the
+// list have those headers ignored.
+//
+// Callers constructing an Exchanger (the aggregated apiserver's cmd wiring) and the
+// proxies.Socket REST storage registering the Tunnel connect-verb must be updated in step with
+// this signature and with the Tunnel entry point below; both live outside pkg/exchanger.
+//
+// This package also reads mcls.Spec.InsecureSkipTLSVerification, mcls.Status.CABundle,
+// mcls.Spec.DisableHTTP2, and mcls.Spec.TunnelAllowedTargets (see getTransport and
+// tunnelTargetAllowed). Those fields, and their generated deepcopy, belong on
+// ManagedClusterSpec/ManagedClusterStatus in pkg/apis/clusters/v1beta1, which — like the
+// cmd/ and REST-storage wiring above — isn't part of this series' diff; it must land
+// alongside these changes for the package to compile.
+func NewExchanger(tunnelLogging, disableHTTP2 bool, impersonationAllowlist []string, mclsInformer clusterInformers.ManagedClusterInformer) *Exchanger {
 	if tunnelLogging {
 		logrus.SetLevel(logrus.DebugLevel)
 		remotedialer.PrintTunnelData = true
 	}
 
 	e := &Exchanger{
-		cachedTransports: map[string]*http.Transport{},
-		dialerServer:     remotedialer.New(authorizer, remotedialer.DefaultErrorWriter),
-		mcLister:         mclsInformer.Lister(),
-		mcSynced:         mclsInformer.Informer().HasSynced,
+		dialHolders:            map[string]*transport.DialHolder{},
+		dialerServer:           remotedialer.New(authorizer, remotedialer.DefaultErrorWriter),
+		mcLister:               mclsInformer.Lister(),
+		mcSynced:               mclsInformer.Informer().HasSynced,
+		disableHTTP2:           disableHTTP2,
+		impersonationAllowlist: sets.NewString(impersonationAllowlist...),
 	}
 	return e
 }
 
-func (e *Exchanger) getClonedTransport(clusterID string) *http.Transport {
-	// return cloned transport to avoid being changed outside
+func (e *Exchanger) dialHolderFor(clusterID string) *transport.DialHolder {
 	e.lock.Lock()
 	defer e.lock.Unlock()
 
-	transport := e.cachedTransports[clusterID]
-	if transport != nil {
-		return transport.Clone()
+	holder, ok := e.dialHolders[clusterID]
+	if ok {
+		dialHolderCacheTotal.WithLabelValues("hit").Inc()
+		return holder
+	}
+
+	dialHolderCacheTotal.WithLabelValues("miss").Inc()
+	holder = &transport.DialHolder{Dial: wrapDialForMetrics(clusterID, e.dialerServer.Dialer(clusterID))}
+	e.dialHolders[clusterID] = holder
+	return holder
+}
+
+// hostWithoutPort strips a ":port" suffix from a host[:port] string, if present, since
+// crypto/tls.Config.ServerName must be a bare host to match a certificate's SANs.
+func hostWithoutPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// no port present (or an otherwise unparsable value); use as-is
+		return hostport
+	}
+	return host
+}
+
+// getTransport builds an http.RoundTripper for the given cluster over the remotedialer tunnel.
+// It delegates transport construction to k8s.io/client-go/transport.New, which maintains its
+// own cache of *http.Transport keyed by the TLS config (including the DialHolder pointer), so
+// repeated calls with the same TLS material reuse the same underlying transport and TLS session
+// cache instead of paying for a fresh handshake on every request.
+func (e *Exchanger) getTransport(clusterID string, certPEM, keyPEM, caBundlePEM []byte, serverName string) (http.RoundTripper, error) {
+	mcls, err := e.lookupManagedCluster(clusterID)
+	if err != nil {
+		return nil, err
 	}
 
-	dialer := e.dialerServer.Dialer(clusterID)
-	transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+	// Verification is on by default; InsecureSkipTLSVerification is the only opt-out, set
+	// explicitly by the operator on the ManagedCluster spec. An empty CA bundle with
+	// verification on is a real, if breaking, misconfiguration: it falls through to
+	// transport.New verifying against the system root pool, which almost never trusts a
+	// managed-cluster apiserver. Operators upgrading onto this must set either
+	// Spec.InsecureSkipTLSVerification or a CA bundle (Status.CABundle / Clusternet-CABundle)
+	// before proxied connections will succeed again.
+	insecure := mcls.Spec.InsecureSkipTLSVerification
+	if insecure {
+		// client-go's transport.New rejects CA data combined with Insecure, and an unverified
+		// connection has no use for it anyway.
+		caBundlePEM = nil
+	} else if len(caBundlePEM) == 0 {
+		caBundlePEM = []byte(mcls.Status.CABundle)
+	}
+
+	disableHTTP2 := e.disableHTTP2 || mcls.Spec.DisableHTTP2
+	var nextProtos []string
+	if disableHTTP2 {
+		// a non-empty NextProtos stops client-go's transport defaulting from layering
+		// http2.ConfigureTransport on top, pinning the connection to HTTP/1.1.
+		nextProtos = []string{"http/1.1"}
+	}
+
+	cfg := &transport.Config{
+		TLS: transport.TLSConfig{
+			Insecure:   insecure,
+			CAData:     caBundlePEM,
+			CertData:   certPEM,
+			KeyData:    keyPEM,
+			// ServerName must be a bare host: crypto/tls matches it against the cert's SANs
+			// verbatim, and location.Host (passed in by the callers of getTransport) can carry a port.
+			ServerName: hostWithoutPort(serverName),
+			NextProtos: nextProtos,
 		},
-		DialContext: dialer,
-		// apply default settings from http.DefaultTransport
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+		DialHolder: e.dialHolderFor(clusterID),
 	}
 
-	e.cachedTransports[clusterID] = transport
-	return transport.Clone()
+	rt, err := transport.New(cfg)
+	if err != nil {
+		tlsHandshakeFailuresTotal.WithLabelValues(clusterID).Inc()
+		return nil, err
+	}
+	return rt, nil
 }
 
 func (e *Exchanger) Connect(ctx context.Context, id string, opts *proxies.Socket, responder rest.Responder) (http.Handler, error) {
@@ -127,18 +240,28 @@ func (e *Exchanger) ProxyConnect(ctx context.Context, id string, opts *proxies.S
 		return nil, err
 	}
 
-	location, transport, err := e.ClusterLocation(id, opts)
+	location, rt, err := e.ClusterLocation(id, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: add metrics
+	shortPath := strconv.FormatBool(isShortRequestPath(opts.Path))
 
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		location.RawQuery = request.URL.RawQuery
 		// proxy and re-dial through websocket connection
 		klog.V(4).Infof("Request to %q will be redialed from cluster %q", location.String(), id)
 
+		tunnelSessions.WithLabelValues(id).Set(boolToFloat64(e.dialerServer.HasSession(id)))
+
+		start := time.Now()
+		sw := &statusCapturingResponseWriter{ResponseWriter: writer, statusCode: http.StatusOK}
+		defer func() {
+			code := strconv.Itoa(sw.statusCode)
+			proxiedRequestsTotal.WithLabelValues(id, request.Method, code, shortPath).Inc()
+			proxiedRequestDuration.WithLabelValues(id, request.Method, code, shortPath).Observe(time.Since(start).Seconds())
+		}()
+
 		extra := getExtraFromHeaders(request.Header, extraHeaderPrefixes)
 
 		if token, ok := extra[strings.ToLower(TokenHeaderKey)]; ok && len(token) > 0 {
@@ -158,71 +281,207 @@ func (e *Exchanger) ProxyConnect(ctx context.Context, id string, opts *proxies.S
 				responder.Error(apierrors.NewBadRequest(fmt.Sprintf("invalid private key in header %s: %v", PrivateKeyHeaderKey, err)))
 				return
 			}
-			cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
-			if err != nil {
+			if _, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock); err != nil {
 				responder.Error(apierrors.NewBadRequest(fmt.Sprintf("invalid key pair in header: %v", err)))
 				return
 			}
 
-			dialer := e.dialerServer.Dialer(id)
-			transport = &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-					Certificates: []tls.Certificate{
-						cert,
-					},
-				},
-				DialContext: dialer,
-				// apply default settings from http.DefaultTransport
-				MaxIdleConns:          100,
-				IdleConnTimeout:       90 * time.Second,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
+			var caBundlePEM []byte
+			if caBundle, ok := extra[strings.ToLower(CABundleHeaderKey)]; ok && len(caBundle) > 0 {
+				caBundlePEM, err = base64.StdEncoding.DecodeString(caBundle[0])
+				if err != nil {
+					responder.Error(apierrors.NewBadRequest(fmt.Sprintf("invalid CA bundle in header %s: %v", CABundleHeaderKey, err)))
+					return
+				}
+			}
+
+			rt, err = e.getTransport(id, certPEMBlock, keyPEMBlock, caBundlePEM, location.Host)
+			if err != nil {
+				responder.Error(apierrors.NewInternalError(err))
+				return
 			}
 		}
 
+		if e.impersonationAllowlist.Has(id) {
+			applyImpersonationHeaders(request.Header, extra)
+		}
+
 		for k := range extra {
 			for _, prefix := range extraHeaderPrefixes {
 				request.Header.Del(prefix + k)
 			}
 		}
 
-		handler := newThrottledUpgradeAwareProxyHandler(location, transport, false, false, true, true, responder)
-		handler.ServeHTTP(writer, request)
+		handler := newThrottledUpgradeAwareProxyHandler(location, rt, false, false, true, true, responder)
+		handler.ServeHTTP(sw, request)
 	})
 
 	return handler, nil
 }
 
-func (e *Exchanger) ClusterLocation(id string, opts *proxies.Socket) (*url.URL, http.RoundTripper, error) {
-	var transport *http.Transport
+// Tunnel serves generic TCP-over-tunnel access to a managed cluster: opts.Path is the
+// "host:port" of an arbitrary in-cluster TCP service (etcd, a database, a private registry),
+// and the returned handler speaks HTTP CONNECT semantics against it. Unlike ProxyConnect,
+// which only understands HTTP(S) requests against the apiserver, Tunnel hijacks the raw
+// client connection and pipes bytes straight through to whatever is listening on host:port,
+// without the exchanger needing to understand the upstream protocol.
+//
+// This method only becomes reachable once the proxies.Socket REST storage routes its connect
+// verb here, alongside the existing ProxyConnect registration; that wiring lives outside
+// pkg/exchanger and must ship in the same series as this method.
+//
+// Driving this handler end-to-end in a test needs a ManagedCluster fixture, a lister/informer
+// pair, and a connected remotedialer session, none of which pkg/exchanger can stand up without
+// the pkg/apis/clusters/v1beta1 fields noted on NewExchanger above and the pkg/generated
+// informers and listers for them. The
+// half-close bug this handler used to have is covered instead at the unit the bug actually
+// lived in (TestHalfClose* in exchanger_test.go); an end-to-end CONNECT test belongs in the
+// same series as the REST wiring.
+func (e *Exchanger) Tunnel(ctx context.Context, id string, opts *proxies.Socket, responder rest.Responder) (http.Handler, error) {
+	if !cache.WaitForCacheSync(ctx.Done(), e.mcSynced) {
+		err := apierrors.NewServiceUnavailable("cache for ManagedCluster is not ready yet, please retry later")
+		responder.Error(err)
+		return nil, err
+	}
+
+	mcls, err := e.lookupManagedCluster(id)
+	if err != nil {
+		responder.Error(err)
+		return nil, err
+	}
+
+	if !e.dialerServer.HasSession(id) {
+		err := apierrors.NewBadRequest(fmt.Sprintf("cannot tunnel through cluster %s, whose agent is disconnected", id))
+		responder.Error(err)
+		return nil, err
+	}
+
+	target := strings.Trim(opts.Path, "/")
+	if !tunnelTargetAllowed(mcls, target) {
+		err := apierrors.NewBadRequest(fmt.Sprintf("target %q is not allowlisted for tunneling on cluster %s", target, id))
+		responder.Error(err)
+		return nil, err
+	}
 
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		dial := e.dialerServer.Dialer(id)
+		upstream, err := dial(request.Context(), "tcp", target)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("failed to dial %s through cluster %s: %v", target, id, err), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		upstream = &countingConn{Conn: upstream, clusterID: id}
+
+		hijacker, ok := writer.(http.Hijacker)
+		if !ok {
+			http.Error(writer, "tunnel requires a hijackable connection", http.StatusInternalServerError)
+			return
+		}
+		clientConn, _, err := hijacker.Hijack()
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("failed to hijack connection: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer clientConn.Close()
+
+		if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			klog.Errorf("failed to ack CONNECT tunnel for cluster %s target %s: %v", id, target, err)
+			return
+		}
+
+		done := make(chan struct{}, 2)
+		go func() {
+			_, _ = io.Copy(upstream, clientConn)
+			// the client is done sending; where the upstream conn supports a half-close, tell
+			// upstream so it can finish up and close its side. A remotedialer conn has no
+			// half-close, so the other goroutine's io.Copy(clientConn, upstream) then runs
+			// until upstream reaches EOF on its own.
+			halfClose(upstream)
+			done <- struct{}{}
+		}()
+		go func() {
+			_, _ = io.Copy(clientConn, upstream)
+			halfClose(clientConn)
+			done <- struct{}{}
+		}()
+		// wait for both directions: one side finishing (e.g. client half-closing after
+		// sending a request) must not cut off an in-flight response on the other side.
+		<-done
+		<-done
+	})
+
+	return handler, nil
+}
+
+// halfClose signals to conn's peer that no more data is coming from this side, without
+// tearing down the direction still carrying data. It only acts when conn implements
+// CloseWrite: falling back to a full Close for a conn that can't half-close (the remotedialer
+// tunnel conn is multiplexed over a single websocket and doesn't support one) would tear down
+// the still-reading direction too, truncating an in-flight response on a long-lived connection
+// — exactly what this is meant to prevent. With no half-close available, the copy goroutine on
+// the still-open direction keeps running until its source reaches EOF on its own, and the
+// deferred Close on both conns in Tunnel cleans up once both directions have finished.
+func halfClose(conn io.Closer) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// tunnelTargetAllowed reports whether target ("host:port") matches one of the glob patterns
+// in mcls.Spec.TunnelAllowedTargets. With no patterns configured, tunneling is denied by
+// default to bound the blast radius of exposing arbitrary in-cluster TCP services.
+func tunnelTargetAllowed(mcls *clusterapi.ManagedCluster, target string) bool {
+	for _, pattern := range mcls.Spec.TunnelAllowedTargets {
+		if matched, err := path.Match(pattern, target); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isShortRequestPath reports whether a Socket's Path addresses the cluster's apiserver
+// directly (the "direct/..." short form) rather than an explicit "scheme/host/path".
+func isShortRequestPath(reqPath string) bool {
+	reqPath = strings.TrimLeft(reqPath, "/")
+	parts := strings.SplitN(reqPath, "/", 2)
+	return len(parts) > 0 && parts[0] == "direct"
+}
+
+// lookupManagedCluster resolves the ManagedCluster registered for the given cluster ID.
+func (e *Exchanger) lookupManagedCluster(id string) (*clusterapi.ManagedCluster, error) {
 	mcls, err := e.mcLister.List(labels.SelectorFromSet(labels.Set{
 		known.ClusterIDLabel: id,
 	}))
 	if err != nil {
-		return nil, nil, apierrors.NewServiceUnavailable(err.Error())
+		return nil, apierrors.NewServiceUnavailable(err.Error())
 	}
-	if mcls == nil {
-		return nil, nil, apierrors.NewBadRequest(fmt.Sprintf("no cluster id is %s", id))
+	if len(mcls) == 0 {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("no cluster id is %s", id))
 	}
 	if len(mcls) > 1 {
 		klog.Warningf("found multiple ManagedCluster dedicated for cluster %s !!!", id)
 	}
+	return mcls[0], nil
+}
+
+func (e *Exchanger) ClusterLocation(id string, opts *proxies.Socket) (*url.URL, http.RoundTripper, error) {
+	var rt http.RoundTripper
+
+	mcls, err := e.lookupManagedCluster(id)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	reqPath := strings.TrimLeft(opts.Path, "/")
 	parts := strings.Split(reqPath, "/")
 	if len(parts) == 0 {
 		return nil, nil, apierrors.NewBadRequest(fmt.Sprintf("unexpected error: invalid request path %s", reqPath))
 	}
-	var isShortPath bool
-	if parts[0] == "direct" {
-		isShortPath = true
-	}
 
 	location := new(url.URL)
-	if isShortPath {
-		apiserverURL := mcls[0].Status.APIServerURL
+	if isShortRequestPath(opts.Path) {
+		apiserverURL := mcls.Status.APIServerURL
 		if len(apiserverURL) == 0 {
 			return nil, nil, apierrors.NewServiceUnavailable(fmt.Sprintf("cannot retrieve valid apiserver url for cluster %s", id))
 		}
@@ -250,14 +509,17 @@ func (e *Exchanger) ClusterLocation(id string, opts *proxies.Socket) (*url.URL,
 		}
 	}
 
-	if mcls[0].Status.UseSocket {
+	if mcls.Status.UseSocket {
 		if !e.dialerServer.HasSession(id) {
 			return nil, nil, apierrors.NewBadRequest(fmt.Sprintf("cannot proxy through cluster %s, whose agent is disconnected", id))
 		}
-		transport = e.getClonedTransport(id)
+		rt, err = e.getTransport(id, nil, nil, nil, location.Host)
+		if err != nil {
+			return nil, nil, apierrors.NewInternalError(err)
+		}
 	}
 
-	return location, transport, nil
+	return location, rt, nil
 }
 
 func newThrottledUpgradeAwareProxyHandler(location *url.URL, transport http.RoundTripper, wrapTransport, upgradeRequired, interceptRedirects, useLocationHost bool, responder rest.Responder) *proxy.UpgradeAwareHandler {
@@ -270,6 +532,39 @@ func newThrottledUpgradeAwareProxyHandler(location *url.URL, transport http.Roun
 	return handler
 }
 
+// applyImpersonationHeaders translates the Clusternet-Impersonate-* extras (already extracted
+// by getExtraFromHeaders, so extra keys are lowercased and %-unescaped) into the standard
+// Kubernetes impersonation headers on the outbound request to the managed cluster's apiserver.
+// Extra keys are re-escaped with url.PathEscape when rebuilding the header name, since an
+// unescaped key can contain bytes that aren't legal in an HTTP header name.
+func applyImpersonationHeaders(header http.Header, extra map[string][]string) {
+	if users := extra[strings.ToLower(ImpersonateUserHeaderKey)]; len(users) > 0 {
+		header.Set(impersonateUserHeader, users[0])
+	}
+
+	for _, group := range extra[strings.ToLower(ImpersonateGroupHeaderKey)] {
+		header.Add(impersonateGroupHeader, group)
+	}
+
+	if uids := extra[strings.ToLower(ImpersonateUIDHeaderKey)]; len(uids) > 0 {
+		header.Set(impersonateUIDHeader, uids[0])
+	}
+
+	extraPrefix := strings.ToLower(ImpersonateExtraHeaderPrefix)
+	for key, values := range extra {
+		if !strings.HasPrefix(key, extraPrefix) {
+			continue
+		}
+		extraKey := strings.TrimPrefix(key, extraPrefix)
+		for _, v := range values {
+			// extraKey was %-unescaped by getExtraFromHeaders and may contain bytes (e.g. '/')
+			// that aren't valid in an HTTP header name; re-escape it the same way the standard
+			// Kubernetes impersonating proxy does so it round-trips as a single header name.
+			header.Add(impersonateExtraHeaderPrefix+url.PathEscape(extraKey), v)
+		}
+	}
+}
+
 // copied from k8s.io/apiserver/pkg/authentication/request/headerrequest/requestheader.go
 func unescapeExtraKey(encodedKey string) string {
 	key, err := url.PathUnescape(encodedKey) // Decode %-encoded bytes.
@@ -0,0 +1,179 @@
+/*
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exchanger
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestApplyImpersonationHeaders(t *testing.T) {
+	tests := []struct {
+		name          string
+		headers       http.Header
+		wantUser      string
+		wantUID       string
+		wantGroups    []string
+		wantExtraKey  string
+		wantExtraVals []string
+	}{
+		{
+			name: "user and uid",
+			headers: http.Header{
+				"Clusternet-Impersonate-User": {"alice"},
+				"Clusternet-Impersonate-Uid":  {"1001"},
+			},
+			wantUser: "alice",
+			wantUID:  "1001",
+		},
+		{
+			name: "multiple groups preserve order",
+			headers: http.Header{
+				"Clusternet-Impersonate-User":  {"bob"},
+				"Clusternet-Impersonate-Group": {"system:masters", "developers"},
+			},
+			wantUser:   "bob",
+			wantGroups: []string{"system:masters", "developers"},
+		},
+		{
+			name: "percent-encoded extra key is unescaped",
+			headers: http.Header{
+				"Clusternet-Impersonate-User":                {"carol"},
+				"Clusternet-Impersonate-Extra-scopes%2Fread": {"true", "1"},
+			},
+			wantUser:      "carol",
+			wantExtraKey:  "scopes/read",
+			wantExtraVals: []string{"true", "1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extra := getExtraFromHeaders(tt.headers, []string{""})
+
+			out := http.Header{}
+			applyImpersonationHeaders(out, extra)
+
+			if got := out.Get("Impersonate-User"); got != tt.wantUser {
+				t.Errorf("Impersonate-User = %q, want %q", got, tt.wantUser)
+			}
+			if tt.wantUID != "" {
+				if got := out.Get("Impersonate-Uid"); got != tt.wantUID {
+					t.Errorf("Impersonate-Uid = %q, want %q", got, tt.wantUID)
+				}
+			}
+			if tt.wantGroups != nil {
+				got := out.Values("Impersonate-Group")
+				if len(got) != len(tt.wantGroups) {
+					t.Fatalf("Impersonate-Group = %v, want %v", got, tt.wantGroups)
+				}
+				for i, g := range tt.wantGroups {
+					if got[i] != g {
+						t.Errorf("Impersonate-Group[%d] = %q, want %q", i, got[i], g)
+					}
+				}
+			}
+			if tt.wantExtraKey != "" {
+				headerName := "Impersonate-Extra-" + url.PathEscape(tt.wantExtraKey)
+				got := out.Values(headerName)
+				if len(got) != len(tt.wantExtraVals) {
+					t.Fatalf("%s = %v, want %v", headerName, got, tt.wantExtraVals)
+				}
+				for i, v := range tt.wantExtraVals {
+					if got[i] != v {
+						t.Errorf("%s[%d] = %q, want %q", headerName, i, got[i], v)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestApplyImpersonationHeadersNoop(t *testing.T) {
+	extra := getExtraFromHeaders(http.Header{
+		"Clusternet-Token": {"some-token"},
+	}, []string{""})
+
+	out := http.Header{}
+	applyImpersonationHeaders(out, extra)
+
+	if len(out) != 0 {
+		t.Errorf("expected no impersonation headers to be set, got %v", out)
+	}
+}
+
+// halfCloseCloser is a plain io.Closer that records whether Close was called, without
+// implementing CloseWrite, modeling a tunnel conn that can't half-close (e.g. remotedialer's).
+type halfCloseCloser struct {
+	closed bool
+}
+
+func (c *halfCloseCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestHalfCloseWithoutCloseWriteSupport(t *testing.T) {
+	conn := &halfCloseCloser{}
+	halfClose(conn)
+
+	if conn.closed {
+		t.Error("halfClose closed a conn with no CloseWrite support; it should have left it open for the other direction to keep reading")
+	}
+}
+
+func TestHalfCloseUsesCloseWriteWhenSupported(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		defer conn.Close()
+		// a successful peer-side read of EOF confirms the write half was actually closed,
+		// rather than the whole connection.
+		_, err = io.Copy(io.Discard, conn)
+		serverDone <- err
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+
+	halfClose(client)
+
+	if err := <-serverDone; err != nil {
+		t.Errorf("server-side read after halfClose: %v", err)
+	}
+
+	// a real half-close only shuts down the write side; writing afterwards must fail.
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("expected write on a half-closed conn to fail")
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 The Clusternet Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exchanger
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "clusternet"
+	metricsSubsystem = "tunnel"
+)
+
+var (
+	tunnelSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "sessions",
+		Help:      "Whether an agent tunnel session was connected for a cluster (1) or not (0) when a request was last proxied to it.",
+	}, []string{"cluster_id"})
+
+	proxiedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "proxied_requests_total",
+		Help:      "Number of requests proxied to managed clusters through the tunnel.",
+	}, []string{"cluster_id", "method", "code", "short_path"})
+
+	proxiedRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "proxied_request_duration_seconds",
+		Help:      "Latency of requests proxied to managed clusters through the tunnel.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"cluster_id", "method", "code", "short_path"})
+
+	tunnelBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "bytes_total",
+		Help:      "Bytes transferred over tunnel connections to managed clusters, by direction.",
+	}, []string{"cluster_id", "direction"})
+
+	tlsHandshakeFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tls_handshake_failures_total",
+		Help:      "Number of failures building the TLS transport for a managed cluster (invalid certificate, key or CA data). Handshake failures on dialed connections are not counted.",
+	}, []string{"cluster_id"})
+
+	dialHolderCacheTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "dial_holder_cache_total",
+		Help:      "Hit/miss counts for reused tunnel dial holders backing the TLS transport cache.",
+	}, []string{"result"})
+
+	registerMetricsOnce sync.Once
+)
+
+// RegisterMetrics registers the exchanger's collectors with the given registerer. The
+// aggregated apiserver calls this once to mount the collectors on its own /metrics endpoint.
+// It is safe to call more than once; registration only happens the first time.
+func RegisterMetrics(registerer prometheus.Registerer) {
+	registerMetricsOnce.Do(func() {
+		registerer.MustRegister(
+			tunnelSessions,
+			proxiedRequestsTotal,
+			proxiedRequestDuration,
+			tunnelBytesTotal,
+			tlsHandshakeFailuresTotal,
+			dialHolderCacheTotal,
+		)
+	})
+}
+
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// countingConn wraps a net.Conn dialed through the tunnel to attribute bytes read and written
+// to the owning cluster for the bytes_total metric.
+type countingConn struct {
+	net.Conn
+	clusterID string
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		tunnelBytesTotal.WithLabelValues(c.clusterID, "in").Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		tunnelBytesTotal.WithLabelValues(c.clusterID, "out").Add(float64(n))
+	}
+	return n, err
+}
+
+// CloseWrite forwards to the wrapped conn's CloseWrite when it has one (e.g. *net.TCPConn), so
+// callers half-closing a countingConn still reach the underlying connection's half-close
+// instead of being stuck behind the net.Conn interface, which doesn't declare CloseWrite. It
+// is a no-op when the wrapped conn can't half-close (e.g. a remotedialer tunnel conn): callers
+// are expected to rely on the wrapped conn's own Close, not this method, to tear it down.
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// wrapDialForMetrics wraps a DialHolder's dial func so every net.Conn it returns reports
+// bytes in/out for the given cluster.
+func wrapDialForMetrics(clusterID string, dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, clusterID: clusterID}, nil
+	}
+}
+
+// statusCapturingResponseWriter records the status code written by the wrapped proxy handler
+// so it can be reported as a metrics label, while still passing through Hijack and Flush for
+// the upgrade (exec/attach/watch) requests the upgrade-aware proxy handler relies on.
+type statusCapturingResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (w *statusCapturingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.statusCode = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusCapturingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.statusCode = http.StatusOK
+		w.wroteHeader = true
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusCapturingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (w *statusCapturingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}